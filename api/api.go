@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -21,6 +22,22 @@ import (
 type RouterAPI struct {
 	DefaultMode     string
 	IngressServices map[string]router.Service
+
+	// Sync disables queued reconciliation, forcing every mutating
+	// request to be applied against Kubernetes synchronously, as was
+	// the only behavior before the reconcile queue was introduced.
+	Sync bool
+
+	// Queue enqueues desired-state changes for the background
+	// reconciler to apply. When it is nil, requests are applied
+	// synchronously, just as when Sync is set.
+	Queue router.ReconcileQueue
+
+	// QueueDepthThreshold and QueueMaxAge make Healthcheck fail once the
+	// reconcile queue is backed up past an operator-configured limit,
+	// surfacing a stuck controller instead of letting it go unnoticed.
+	QueueDepthThreshold int
+	QueueMaxAge         time.Duration
 }
 
 // Routes returns an mux for the API routes
@@ -40,6 +57,7 @@ func (a *RouterAPI) registerRoutes(r *mux.Router) {
 	r.Handle("/backend/{name}/routes", handler(a.addRoutes)).Methods(http.MethodPost)
 	r.Handle("/backend/{name}/routes/remove", handler(a.removeRoutes)).Methods(http.MethodPost)
 	r.Handle("/backend/{name}/swap", handler(a.swap)).Methods(http.MethodPost)
+	r.Handle("/backend/{name}/status", handler(a.backendStatus)).Methods(http.MethodGet)
 
 	r.Handle("/info", handler(a.info)).Methods(http.MethodGet)
 
@@ -53,24 +71,39 @@ func (a *RouterAPI) registerRoutes(r *mux.Router) {
 	r.Handle("/backend/{name}/cname", handler(a.getCnames)).Methods(http.MethodGet)
 	r.Handle("/backend/{name}/cname/{cname}", handler(a.unsetCname)).Methods(http.MethodDelete)
 
+	// Middleware
+	r.Handle("/backend/{name}/middleware/{mwname}", handler(a.addMiddleware)).Methods(http.MethodPut)
+	r.Handle("/backend/{name}/middleware/{mwname}", handler(a.getMiddleware)).Methods(http.MethodGet)
+	r.Handle("/backend/{name}/middleware/{mwname}", handler(a.removeMiddleware)).Methods(http.MethodDelete)
+
 	// Supports
 	r.Handle("/support/tls", handler(a.supportTLS)).Methods(http.MethodGet)
 	r.Handle("/support/cname", handler(a.supportCNAME)).Methods(http.MethodGet)
+	r.Handle("/support/class", handler(a.supportClass)).Methods(http.MethodGet)
+	r.Handle("/support/acme", handler(a.supportACME)).Methods(http.MethodGet)
 	r.Handle("/support/info", handler(func(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusOK)
 		return nil
 	})).Methods(http.MethodGet)
 	r.Handle("/support/prefix", handler(func(w http.ResponseWriter, r *http.Request) error {
-		w.WriteHeader(http.StatusOK)
-		return nil
+		_, err := w.Write([]byte("true"))
+		return err
 	})).Methods(http.MethodGet)
 }
 
-func (a *RouterAPI) ingressService(mode string) (router.Service, error) {
+// effectiveMode resolves the {mode} path variable to the mode key
+// actually used to look up a Service and to key the reconcile queue,
+// falling back to DefaultMode for the no-{mode} routes tsuru normally
+// calls.
+func (a *RouterAPI) effectiveMode(mode string) string {
 	if mode == "" {
-		mode = a.DefaultMode
+		return a.DefaultMode
 	}
-	svc, ok := a.IngressServices[mode]
+	return mode
+}
+
+func (a *RouterAPI) ingressService(mode string) (router.Service, error) {
+	svc, ok := a.IngressServices[a.effectiveMode(mode)]
 	if !ok {
 		return nil, httpError{Status: http.StatusNotFound}
 	}
@@ -110,6 +143,26 @@ func (a *RouterAPI) getBackend(w http.ResponseWriter, r *http.Request) error {
 	return json.NewEncoder(w).Encode(rsp)
 }
 
+// apply runs fn synchronously when a.Sync is set or no Queue has been
+// wired up, otherwise it enqueues desired into the reconcile queue and
+// responds 202 Accepted with the resulting task id. The background
+// controller applies queued changes against Kubernetes, retrying
+// transient apiserver errors instead of surfacing them to the caller.
+// A RouterAPI built without a Queue behaves exactly as it did before
+// the reconcile queue existed, so callers that haven't been updated to
+// wire one up keep working.
+func (a *RouterAPI) apply(w http.ResponseWriter, id router.InstanceID, mode string, desired router.DesiredState, fn func() error) error {
+	if a.Sync || a.Queue == nil {
+		return fn()
+	}
+	taskID, err := a.Queue.Enqueue(id, mode, desired)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(map[string]string{"task_id": taskID})
+}
+
 // addBackend creates a Ingress for a given app configuration pointing
 // to a non existent service
 func (a *RouterAPI) addBackend(w http.ResponseWriter, r *http.Request) error {
@@ -124,11 +177,15 @@ func (a *RouterAPI) addBackend(w http.ResponseWriter, r *http.Request) error {
 	if len(routerOpts.Domain) > 0 && len(routerOpts.Route) == 0 {
 		routerOpts.Route = "/"
 	}
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
-	return svc.Create(instanceID(r), routerOpts)
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{Create: &routerOpts}, func() error {
+		return svc.Create(id, routerOpts)
+	})
 }
 
 // updateBackend is no-op
@@ -139,14 +196,22 @@ func (a *RouterAPI) updateBackend(w http.ResponseWriter, r *http.Request) error
 // removeBackend removes the Ingress for a given app
 func (a *RouterAPI) removeBackend(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
-	return svc.Remove(instanceID(r))
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{Remove: true}, func() error {
+		return svc.Remove(id)
+	})
 }
 
-// addRoutes updates the Ingress to point to the correct service
+// addRoutes updates the Ingress to point to the correct service. It is
+// called once per prefix reported by tsuru, including the default
+// ("/") prefix, so the Service implementation is responsible for
+// accumulating the prefixes it has seen for a given InstanceID;
+// removeRoutes is what reconciles a prefix that stops being sent.
 func (a *RouterAPI) addRoutes(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 
@@ -155,22 +220,41 @@ func (a *RouterAPI) addRoutes(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	if routesData.Prefix != "" {
-		// Do nothing for all prefixes, except the default one.
-		return nil
-	}
 
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
 
-	return svc.Update(instanceID(r), routesData.ExtraData)
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{Routes: &routesData}, func() error {
+		return svc.Update(id, routesData)
+	})
 }
 
-// removeRoutes is no-op
+// removeRoutes drops the path rule for the prefix in the request body,
+// called by tsuru once a previously reported prefix stops being
+// exposed by the app.
 func (a *RouterAPI) removeRoutes(w http.ResponseWriter, r *http.Request) error {
-	return nil
+	vars := mux.Vars(r)
+
+	var routesData router.RoutesRequestData
+	err := json.NewDecoder(r.Body).Decode(&routesData)
+	if err != nil {
+		return err
+	}
+
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
+	if err != nil {
+		return err
+	}
+
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{RemoveRoutes: &routesData}, func() error {
+		return svc.RemoveRoutes(id, routesData)
+	})
 }
 
 // getRoutes always returns an empty address list to force tsuru to call
@@ -195,7 +279,8 @@ func (a *RouterAPI) swap(w http.ResponseWriter, r *http.Request) error {
 	if req.Target == "" {
 		return httpError{Body: "empty target", Status: http.StatusBadRequest}
 	}
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
@@ -204,7 +289,23 @@ func (a *RouterAPI) swap(w http.ResponseWriter, r *http.Request) error {
 		InstanceName: src.InstanceName,
 		AppName:      req.Target,
 	}
-	return svc.Swap(src, dst)
+	return a.apply(w, src, mode, router.DesiredState{Swap: &dst}, func() error {
+		return svc.Swap(src, dst)
+	})
+}
+
+// backendStatus reports whether the last desired-state change queued
+// for the backend has been reconciled yet.
+func (a *RouterAPI) backendStatus(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if a.Sync || a.Queue == nil {
+		return json.NewEncoder(w).Encode(router.ReconcileStatus{State: router.ReconcileStateReconciled})
+	}
+	status, err := a.Queue.Status(instanceID(r), a.effectiveMode(vars["mode"]))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(status)
 }
 
 func (a *RouterAPI) info(w http.ResponseWriter, r *http.Request) error {
@@ -223,6 +324,12 @@ func (a *RouterAPI) info(w http.ResponseWriter, r *http.Request) error {
 		}
 		info[k] = vv
 	}
+	if classSvc, ok := svc.(router.ServiceClass); ok {
+		info["ingress-class"] = classSvc.IngressClass()
+	}
+	if _, ok := svc.(router.ServiceACME); ok {
+		info["acme"] = "true"
+	}
 	return json.NewEncoder(w).Encode(info)
 }
 
@@ -242,6 +349,14 @@ func (a *RouterAPI) Healthcheck(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 	}
+	if !a.Sync && a.Queue != nil {
+		if depth := a.Queue.Depth(); a.QueueDepthThreshold > 0 && depth > a.QueueDepthThreshold {
+			errors = append(errors, fmt.Sprintf("reconcile queue depth %d exceeds threshold %d", depth, a.QueueDepthThreshold))
+		}
+		if age := a.Queue.OldestPendingAge(); a.QueueMaxAge > 0 && age > a.QueueMaxAge {
+			errors = append(errors, fmt.Sprintf("oldest queued item age %s exceeds threshold %s", age, a.QueueMaxAge))
+		}
+	}
 	if len(errors) > 0 {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, err = w.Write([]byte(strings.Join(errors, " - ")))
@@ -261,11 +376,20 @@ func (a *RouterAPI) addCertificate(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
-	return svc.(router.ServiceTLS).AddCertificate(instanceID(r), certName, cert)
+	if cert.Issuer != "" {
+		if _, ok := svc.(router.ServiceACME); !ok {
+			return httpError{Body: "mode does not support managed TLS", Status: http.StatusBadRequest}
+		}
+	}
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{CertName: certName, Certificate: &cert}, func() error {
+		return svc.(router.ServiceTLS).AddCertificate(id, certName, cert)
+	})
 }
 
 // getCertificate Return certificate for app
@@ -315,18 +439,26 @@ func (a *RouterAPI) setCname(w http.ResponseWriter, r *http.Request) error {
 	name := vars["name"]
 	cname := vars["cname"]
 	log.Printf("Adding on %s CNAME %s", name, cname)
-	svc, err := a.ingressService(vars["mode"])
+	mode := a.effectiveMode(vars["mode"])
+	svc, err := a.ingressService(mode)
 	if err != nil {
 		return err
 	}
-	err = svc.(router.ServiceCNAME).SetCname(instanceID(r), cname)
-	if err != nil {
-		if strings.Contains(err.Error(), "exists") {
-			w.WriteHeader(http.StatusConflict)
+	id := instanceID(r)
+	return a.apply(w, id, mode, router.DesiredState{Cname: &cname}, func() error {
+		err = svc.(router.ServiceCNAME).SetCname(id, cname)
+		if err != nil {
+			if strings.Contains(err.Error(), "exists") {
+				w.WriteHeader(http.StatusConflict)
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return err
 		}
-		w.WriteHeader(http.StatusNotFound)
-	}
-	return err
+		if acmeSvc, ok := svc.(router.ServiceACME); ok {
+			return acmeSvc.SyncTLSHosts(id)
+		}
+		return nil
+	})
 }
 
 // getCnames Return CNAMEs for app
@@ -361,7 +493,77 @@ func (a *RouterAPI) unsetCname(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	return svc.(router.ServiceCNAME).UnsetCname(instanceID(r), cname)
+	id := instanceID(r)
+	if err = svc.(router.ServiceCNAME).UnsetCname(id, cname); err != nil {
+		return err
+	}
+	if acmeSvc, ok := svc.(router.ServiceACME); ok {
+		return acmeSvc.SyncTLSHosts(id)
+	}
+	return nil
+}
+
+// addMiddleware adds or updates a middleware attached to the backend's
+// route chain. The request body describes one of the supported
+// middleware kinds (headers, redirectScheme, stripPrefix, rateLimit,
+// basicAuth); unsupported kinds are rejected by the Service
+// implementation.
+func (a *RouterAPI) addMiddleware(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	mwName := vars["mwname"]
+	log.Printf("Adding on %s middleware %s", name, mwName)
+	var mw router.Middleware
+	err := json.NewDecoder(r.Body).Decode(&mw)
+	if err != nil {
+		return err
+	}
+	svc, err := a.ingressService(vars["mode"])
+	if err != nil {
+		return err
+	}
+	return svc.(router.ServiceMiddleware).AddMiddleware(instanceID(r), mwName, mw)
+}
+
+// getMiddleware returns the middleware configuration attached to the backend
+func (a *RouterAPI) getMiddleware(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	mwName := vars["mwname"]
+	log.Printf("Getting middleware %s from %s", mwName, name)
+	svc, err := a.ingressService(vars["mode"])
+	if err != nil {
+		return err
+	}
+	mw, err := svc.(router.ServiceMiddleware).GetMiddleware(instanceID(r), mwName)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return err
+	}
+	b, err := json.Marshal(&mw)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
+
+// removeMiddleware removes a middleware from the backend's route chain
+func (a *RouterAPI) removeMiddleware(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	mwName := vars["mwname"]
+	log.Printf("Removing middleware %s from %s", mwName, name)
+	svc, err := a.ingressService(vars["mode"])
+	if err != nil {
+		return err
+	}
+	err = svc.(router.ServiceMiddleware).RemoveMiddleware(instanceID(r), mwName)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return err
 }
 
 // Check for TLS Support
@@ -399,3 +601,41 @@ func (a *RouterAPI) supportCNAME(w http.ResponseWriter, r *http.Request) error {
 	_, err = w.Write([]byte("OK"))
 	return err
 }
+
+// Check for IngressClass support and, when present, report the
+// effective class for the registered service so operators can confirm
+// which controller a given mode is bound to.
+func (a *RouterAPI) supportClass(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	vars := mux.Vars(r)
+	svc, err := a.ingressService(vars["mode"])
+	if err != nil {
+		return err
+	}
+	classSvc, ok := svc.(router.ServiceClass)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, err = w.Write([]byte("No IngressClass Capabilities"))
+		return err
+	}
+	_, err = w.Write([]byte(classSvc.IngressClass()))
+	return err
+}
+
+// Check for managed TLS (cert-manager/ACME) Support
+func (a *RouterAPI) supportACME(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	vars := mux.Vars(r)
+	svc, err := a.ingressService(vars["mode"])
+	if err != nil {
+		return err
+	}
+	_, ok := svc.(router.ServiceACME)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, err = w.Write([]byte("No ACME Capabilities"))
+		return err
+	}
+	_, err = w.Write([]byte("OK"))
+	return err
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tsuru/kubernetes-router/router"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// certManagerIssuerAnnotation names the ClusterIssuer a cert-manager
+// Certificate should be issued from.
+const certManagerIssuerAnnotation = "cert-manager.io/cluster-issuer"
+
+// certIssuersAnnotation stores, as a JSON-encoded map[certName]issuer,
+// which of a backend's certificates are cert-manager managed. A
+// certName absent from the map (or mapped to "") was added through the
+// plain PEM path; GetCertificate uses this to tell the two apart on a
+// per-certificate basis instead of per-service.
+const certIssuersAnnotation = "router.tsuru.io/cert-issuers"
+
+var certificateGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+var _ router.ServiceACME = &IngressService{}
+
+func (s *IngressService) certificates() dynamic.ResourceInterface {
+	return s.Dynamic.Resource(certificateGVR).Namespace(s.namespace())
+}
+
+func (s *IngressService) certificateName(id router.InstanceID, certName string) string {
+	return s.secretName(id, certName)
+}
+
+// addManagedCertificate creates (or updates) a cert-manager Certificate
+// requesting cert.Issuer as ClusterIssuer, with the backend's current
+// CNAMEs as DNS names, and records certName as ACME-managed so
+// GetCertificate knows to read its live status back from cert-manager
+// instead of the Secret directly.
+func (s *IngressService) addManagedCertificate(id router.InstanceID, certName string, cert router.CertData) error {
+	cnames, err := s.GetCnames(id)
+	if err != nil {
+		return err
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cert-manager.io/v1",
+		"kind":       "Certificate",
+		"metadata": map[string]interface{}{
+			"name":      s.certificateName(id, certName),
+			"namespace": s.namespace(),
+		},
+		"spec": map[string]interface{}{
+			"secretName": s.secretName(id, certName),
+			"dnsNames":   dnsNamesInterface(cnames.Cnames),
+			"issuerRef": map[string]interface{}{
+				"name": cert.Issuer,
+				"kind": "ClusterIssuer",
+			},
+		},
+	}}
+	_, err = s.certificates().Create(context.Background(), obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, getErr := s.certificates().Get(context.Background(), s.certificateName(id, certName), metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if err := unstructured.SetNestedStringSlice(existing.Object, cnames.Cnames, "spec", "dnsNames"); err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedField(existing.Object, cert.Issuer, "spec", "issuerRef", "name"); err != nil {
+			return err
+		}
+		_, err = s.certificates().Update(context.Background(), existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.setCertIssuer(id, certName, cert.Issuer); err != nil {
+		return err
+	}
+	return s.attachSecretToIngress(id, certName)
+}
+
+// managedCertificateStatus returns the CertData reflecting a
+// cert-manager managed certificate's live status, reading the PEM
+// material from its Secret (once cert-manager has populated it) and
+// Ready/RenewalTime/DNSNames from the Certificate object itself.
+func (s *IngressService) managedCertificateStatus(id router.InstanceID, certName, issuer string) (router.CertData, error) {
+	obj, err := s.certificates().Get(context.Background(), s.certificateName(id, certName), metav1.GetOptions{})
+	if err != nil {
+		return router.CertData{}, err
+	}
+	cert := router.CertData{Issuer: issuer}
+
+	dnsNames, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "dnsNames")
+	cert.DNSNames = dnsNames
+
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["type"] != "Ready" {
+			continue
+		}
+		ready := cond["status"] == "True"
+		cert.Ready = &ready
+	}
+	if renewalTime, ok, _ := unstructured.NestedString(obj.Object, "status", "renewalTime"); ok {
+		if t, err := time.Parse(time.RFC3339, renewalTime); err == nil {
+			cert.RenewalTime = &t
+		}
+	}
+
+	secret, err := s.Client.CoreV1().Secrets(s.namespace()).Get(context.Background(), s.secretName(id, certName), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return cert, nil
+		}
+		return router.CertData{}, err
+	}
+	cert.Certificate = string(secret.Data[corev1.TLSCertKey])
+	cert.Key = string(secret.Data[corev1.TLSPrivateKeyKey])
+	return cert, nil
+}
+
+// SyncTLSHosts implements router.ServiceACME, recomputing the dnsNames
+// of every cert-manager managed certificate for id from its current
+// CNAMEs, so a cert renews to cover a CNAME added or removed after it
+// was issued.
+func (s *IngressService) SyncTLSHosts(id router.InstanceID) error {
+	issuers, err := s.certIssuers(id)
+	if err != nil {
+		return err
+	}
+	cnames, err := s.GetCnames(id)
+	if err != nil {
+		return err
+	}
+	for certName, issuer := range issuers {
+		if issuer == "" {
+			continue
+		}
+		obj, err := s.certificates().Get(context.Background(), s.certificateName(id, certName), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedStringSlice(obj.Object, cnames.Cnames, "spec", "dnsNames"); err != nil {
+			return err
+		}
+		if _, err := s.certificates().Update(context.Background(), obj, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *IngressService) setCertIssuer(id router.InstanceID, certName, issuer string) error {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return err
+	}
+	issuers, err := decodeCertIssuers(ing.Annotations[certIssuersAnnotation])
+	if err != nil {
+		return err
+	}
+	if issuers == nil {
+		issuers = map[string]string{}
+	}
+	if issuer == "" {
+		delete(issuers, certName)
+	} else {
+		issuers[certName] = issuer
+	}
+	encoded, err := json.Marshal(issuers)
+	if err != nil {
+		return err
+	}
+	if ing.Annotations == nil {
+		ing.Annotations = map[string]string{}
+	}
+	ing.Annotations[certIssuersAnnotation] = string(encoded)
+	if issuer != "" {
+		ing.Annotations[certManagerIssuerAnnotation] = issuer
+	}
+	_, err = s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), ing, metav1.UpdateOptions{})
+	return err
+}
+
+// certIssuer reports the cert-manager issuer certName was added with,
+// or "" if it was added through the plain PEM path.
+func (s *IngressService) certIssuer(id router.InstanceID, certName string) (string, error) {
+	issuers, err := s.certIssuers(id)
+	if err != nil {
+		return "", err
+	}
+	return issuers[certName], nil
+}
+
+func (s *IngressService) certIssuers(id router.InstanceID) (map[string]string, error) {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCertIssuers(ing.Annotations[certIssuersAnnotation])
+}
+
+func decodeCertIssuers(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var issuers map[string]string
+	if err := json.Unmarshal([]byte(raw), &issuers); err != nil {
+		return nil, fmt.Errorf("failed to decode cert issuers annotation: %w", err)
+	}
+	return issuers, nil
+}
+
+func dnsNamesInterface(names []string) []interface{} {
+	out := make([]interface{}, len(names))
+	for i, n := range names {
+		out[i] = n
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package kubernetes implements the router.Service backends that talk
+// to a Kubernetes cluster on behalf of the HTTP API.
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tsuru/kubernetes-router/router"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ingressClassAnnotation is the legacy annotation ingress-nginx and
+// other controllers still honor alongside spec.ingressClassName.
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// BaseService holds the fields shared by every Kubernetes-backed
+// router.Service implementation.
+type BaseService struct {
+	Namespace string
+	Client    kubernetes.Interface
+
+	// Dynamic is used to manage custom resources (IngressRoute,
+	// Middleware, cert-manager's Certificate) that don't have a typed
+	// client available.
+	Dynamic dynamic.Interface
+
+	// Namespaces restricts which namespaces this instance is allowed to
+	// operate on, so multiple kubernetes-router instances can share a
+	// cluster, each owning a subset of tenants. An empty list means no
+	// restriction beyond Namespace.
+	Namespaces []string
+
+	// IngressClassName is stamped onto every Ingress this instance
+	// creates, both as the kubernetes.io/ingress.class annotation (for
+	// controllers that still rely on it) and spec.ingressClassName.
+	IngressClassName string
+
+	// ControllerName is the controller string backing the IngressClass
+	// resource (e.g. "k8s.io/ingress-nginx"), used to validate that
+	// IngressClassName actually points at the controller this instance
+	// expects before it touches any Ingress owned by that class.
+	ControllerName string
+}
+
+// IngressClass implements router.ServiceClass.
+func (s *BaseService) IngressClass() string {
+	return s.IngressClassName
+}
+
+// namespace returns the namespace every InstanceID is reconciled in:
+// the service-wide Namespace, or "default" when it is unset.
+func (s *BaseService) namespace() string {
+	if s.Namespace != "" {
+		return s.Namespace
+	}
+	return "default"
+}
+
+// namespaceAllowed reports whether ns is a namespace this instance is
+// configured to manage.
+func (s *BaseService) namespaceAllowed(ns string) bool {
+	if len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, allowed := range s.Namespaces {
+		if allowed == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClass refuses to operate on a namespace this instance isn't
+// configured for, or an Ingress stamped with a different IngressClass
+// than the one this instance owns, so two kubernetes-router instances
+// pointed at distinct namespaces/controllers can share a cluster
+// without fighting over each other's resources. An empty
+// annotatedClass (e.g. a resource created before class support existed)
+// is treated as owned. IngressService routes every Ingress fetch
+// through it via getOwnedIngress; IngressRouteService does not call
+// it, so IngressRoutes and Middlewares are neither class- nor
+// namespace-checked.
+func (s *BaseService) checkClass(annotatedClass string) error {
+	if !s.namespaceAllowed(s.namespace()) {
+		return fmt.Errorf("namespace %q is not allowed for this instance", s.namespace())
+	}
+	if s.IngressClassName != "" && annotatedClass != "" && annotatedClass != s.IngressClassName {
+		return fmt.Errorf("ingress class %q does not match this instance's class %q", annotatedClass, s.IngressClassName)
+	}
+	return s.checkController()
+}
+
+// checkController validates that IngressClassName's backing
+// IngressClass resource is actually driven by the controller this
+// instance expects, so a misconfigured IngressClassName can't silently
+// let this instance manage resources meant for a different controller.
+// It is a no-op unless both IngressClassName and ControllerName are set.
+func (s *BaseService) checkController() error {
+	if s.IngressClassName == "" || s.ControllerName == "" {
+		return nil
+	}
+	class, err := s.Client.NetworkingV1().IngressClasses().Get(context.Background(), s.IngressClassName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if class.Spec.Controller != s.ControllerName {
+		return fmt.Errorf("ingress class %q is driven by controller %q, not %q", s.IngressClassName, class.Spec.Controller, s.ControllerName)
+	}
+	return nil
+}
+
+// ingressName returns the Kubernetes object name used for a given
+// InstanceID, matching the naming scheme every backend (Ingress,
+// IngressRoute, Middleware) relies on to find an app's resources.
+func (s *BaseService) ingressName(id router.InstanceID) string {
+	if id.InstanceName != "" {
+		return fmt.Sprintf("%s-%s", id.AppName, id.InstanceName)
+	}
+	return id.AppName
+}
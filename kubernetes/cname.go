@@ -0,0 +1,98 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tsuru/kubernetes-router/router"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cname helper methods all fetch the backend's Ingress through
+// getOwnedIngress instead of the raw client, so they can't be used to
+// read or write an Ingress owned by a different IngressClass/namespace.
+
+// cnamesAnnotation stores the extra CNAMEs registered for a backend as
+// a JSON-encoded []string.
+const cnamesAnnotation = "router.tsuru.io/cnames"
+
+// SetCname registers an additional hostname for the backend's Ingress.
+func (s *IngressService) SetCname(id router.InstanceID, cname string) error {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return err
+	}
+	cnames, err := decodeCnames(ing.Annotations[cnamesAnnotation])
+	if err != nil {
+		return err
+	}
+	for _, existing := range cnames {
+		if existing == cname {
+			return fmt.Errorf("cname %q already exists for backend", cname)
+		}
+	}
+	cnames = append(cnames, cname)
+	return s.saveCnames(ing, cnames)
+}
+
+// GetCnames returns the CNAMEs registered for the backend.
+func (s *IngressService) GetCnames(id router.InstanceID) (*router.CnameResp, error) {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return nil, err
+	}
+	cnames, err := decodeCnames(ing.Annotations[cnamesAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	return &router.CnameResp{Cnames: cnames}, nil
+}
+
+// UnsetCname removes a previously registered CNAME.
+func (s *IngressService) UnsetCname(id router.InstanceID, cname string) error {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return err
+	}
+	cnames, err := decodeCnames(ing.Annotations[cnamesAnnotation])
+	if err != nil {
+		return err
+	}
+	filtered := cnames[:0]
+	for _, existing := range cnames {
+		if existing != cname {
+			filtered = append(filtered, existing)
+		}
+	}
+	return s.saveCnames(ing, filtered)
+}
+
+func (s *IngressService) saveCnames(ing *networkingv1.Ingress, cnames []string) error {
+	encoded, err := json.Marshal(cnames)
+	if err != nil {
+		return err
+	}
+	if ing.Annotations == nil {
+		ing.Annotations = map[string]string{}
+	}
+	ing.Annotations[cnamesAnnotation] = string(encoded)
+	_, err = s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), ing, metav1.UpdateOptions{})
+	return err
+}
+
+func decodeCnames(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var cnames []string
+	if err := json.Unmarshal([]byte(raw), &cnames); err != nil {
+		return nil, fmt.Errorf("failed to decode cnames annotation: %w", err)
+	}
+	return cnames, nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/tsuru/kubernetes-router/router"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// prefixesAnnotation stores the set of route prefixes tsuru has
+	// reported for this backend so far, as a JSON-encoded
+	// map[prefix]router.ExtraData. It lets Update reconstruct which
+	// prefixes are currently live across restarts and diff against what
+	// a given addRoutes call reports, so path rules for prefixes that
+	// stop being reported can be removed.
+	prefixesAnnotation = "router.tsuru.io/prefixes"
+
+	defaultPrefix = "/"
+)
+
+// IngressService manages a backend as a single networking.k8s.io/v1
+// Ingress, one path rule per route prefix.
+type IngressService struct {
+	BaseService
+}
+
+var (
+	_ router.Service               = &IngressService{}
+	_ router.ServiceTLS             = &IngressService{}
+	_ router.ServiceCNAME           = &IngressService{}
+	_ router.HealthcheckableService = &IngressService{}
+)
+
+// getOwnedIngress fetches the Ingress for id and refuses to return it
+// if it's stamped with a different IngressClass than this instance's.
+func (s *IngressService) getOwnedIngress(id router.InstanceID) (*networkingv1.Ingress, error) {
+	ing, err := s.Client.NetworkingV1().Ingresses(s.namespace()).Get(context.Background(), s.ingressName(id), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkClass(ing.Annotations[ingressClassAnnotation]); err != nil {
+		return nil, err
+	}
+	return ing, nil
+}
+
+// Create creates the Ingress for a backend with an empty prefix set and
+// no path rules; the first Update adds them, including the default
+// ("/") rule.
+func (s *IngressService) Create(id router.InstanceID, opts router.Opts) error {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.ingressName(id),
+			Namespace: s.namespace(),
+			Annotations: map[string]string{
+				prefixesAnnotation: "{}",
+			},
+		},
+	}
+	if s.IngressClassName != "" {
+		ing.Annotations[ingressClassAnnotation] = s.IngressClassName
+		ing.Spec.IngressClassName = &s.IngressClassName
+	}
+	_, err := s.Client.NetworkingV1().Ingresses(s.namespace()).Create(context.Background(), ing, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// Remove deletes the Ingress backing the app.
+func (s *IngressService) Remove(id router.InstanceID) error {
+	if _, err := s.getOwnedIngress(id); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	err := s.Client.NetworkingV1().Ingresses(s.namespace()).Delete(context.Background(), s.ingressName(id), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Update adds or overwrites the path rule for routesData.Prefix. The
+// current set of prefixes is persisted on the Ingress as the
+// prefixesAnnotation so it survives controller restarts; RemoveRoutes
+// is what drops a prefix once tsuru stops reporting it.
+func (s *IngressService) Update(id router.InstanceID, routesData router.RoutesRequestData) error {
+	prefix := routesData.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return s.updatePrefixes(id, func(prefixes map[string]router.ExtraData) {
+		prefixes[prefix] = routesData.ExtraData
+	})
+}
+
+// RemoveRoutes drops the path rule for routesData.Prefix, reconciling
+// the Ingress so prefixes the app no longer exposes stop being routed.
+func (s *IngressService) RemoveRoutes(id router.InstanceID, routesData router.RoutesRequestData) error {
+	prefix := routesData.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return s.updatePrefixes(id, func(prefixes map[string]router.ExtraData) {
+		delete(prefixes, prefix)
+	})
+}
+
+// updatePrefixes fetches the backend's current prefix set, lets mutate
+// add or remove an entry, and persists the result as both the
+// prefixesAnnotation and the Ingress's path rules.
+func (s *IngressService) updatePrefixes(id router.InstanceID, mutate func(map[string]router.ExtraData)) error {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := decodePrefixes(ing.Annotations[prefixesAnnotation])
+	if err != nil {
+		return err
+	}
+	if prefixes == nil {
+		prefixes = map[string]router.ExtraData{}
+	}
+	mutate(prefixes)
+
+	encoded, err := encodePrefixes(prefixes)
+	if err != nil {
+		return err
+	}
+	if ing.Annotations == nil {
+		ing.Annotations = map[string]string{}
+	}
+	ing.Annotations[prefixesAnnotation] = encoded
+	ing.Spec.Rules = buildRules(prefixes)
+
+	_, err = s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), ing, metav1.UpdateOptions{})
+	return err
+}
+
+// buildRules turns the accumulated prefix -> ExtraData map into the
+// Ingress path rules. It always includes a "/" rule; when no "/"
+// prefix has been reported, that rule carries an empty ExtraData and so
+// names no backend Service.
+func buildRules(prefixes map[string]router.ExtraData) []networkingv1.IngressRule {
+	if _, ok := prefixes[defaultPrefix]; !ok {
+		prefixes = mergeDefault(prefixes)
+	}
+	paths := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		paths = append(paths, prefix)
+	}
+	sort.Strings(paths)
+
+	pathType := networkingv1.PathTypePrefix
+	rule := networkingv1.IngressRule{
+		IngressRuleValue: networkingv1.IngressRuleValue{
+			HTTP: &networkingv1.HTTPIngressRuleValue{},
+		},
+	}
+	for _, prefix := range paths {
+		extra := prefixes[prefix]
+		rule.HTTP.Paths = append(rule.HTTP.Paths, networkingv1.HTTPIngressPath{
+			Path:     prefix,
+			PathType: &pathType,
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: extra["service-name"],
+					Port: networkingv1.ServiceBackendPort{
+						Name: extra["service-port"],
+					},
+				},
+			},
+		})
+	}
+	return []networkingv1.IngressRule{rule}
+}
+
+func mergeDefault(prefixes map[string]router.ExtraData) map[string]router.ExtraData {
+	merged := make(map[string]router.ExtraData, len(prefixes)+1)
+	for k, v := range prefixes {
+		merged[k] = v
+	}
+	merged[defaultPrefix] = router.ExtraData{}
+	return merged
+}
+
+// GetAddresses returns the load balancer address assigned to the
+// backend's Ingress.
+func (s *IngressService) GetAddresses(id router.InstanceID) ([]string, error) {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			addrs = append(addrs, lb.IP)
+		}
+		if lb.Hostname != "" {
+			addrs = append(addrs, lb.Hostname)
+		}
+	}
+	return addrs, nil
+}
+
+// Swap exchanges the path rules and the prefixes annotation of two
+// backends' Ingresses, effectively swapping which app each one routes
+// to. Other annotations (CNAMEs, certificates) stay where they are.
+func (s *IngressService) Swap(srcID, dstID router.InstanceID) error {
+	src, err := s.getOwnedIngress(srcID)
+	if err != nil {
+		return err
+	}
+	dst, err := s.getOwnedIngress(dstID)
+	if err != nil {
+		return err
+	}
+	src.Spec.Rules, dst.Spec.Rules = dst.Spec.Rules, src.Spec.Rules
+	src.Annotations[prefixesAnnotation], dst.Annotations[prefixesAnnotation] = dst.Annotations[prefixesAnnotation], src.Annotations[prefixesAnnotation]
+	if _, err := s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), src, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	_, err = s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), dst, metav1.UpdateOptions{})
+	return err
+}
+
+// SupportedOptions reports the Opts keys this backend understands.
+func (s *IngressService) SupportedOptions() map[string]string {
+	return map[string]string{
+		"domain": "",
+		"route":  "",
+	}
+}
+
+// Healthcheck confirms the configured namespace is reachable.
+func (s *IngressService) Healthcheck() error {
+	_, err := s.Client.NetworkingV1().Ingresses(s.namespace()).List(context.Background(), metav1.ListOptions{Limit: 1})
+	return err
+}
+
+func encodePrefixes(prefixes map[string]router.ExtraData) (string, error) {
+	b, err := json.Marshal(prefixes)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode prefixes: %w", err)
+	}
+	return string(b), nil
+}
+
+func decodePrefixes(raw string) (map[string]router.ExtraData, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var prefixes map[string]router.ExtraData
+	if err := json.Unmarshal([]byte(raw), &prefixes); err != nil {
+		return nil, fmt.Errorf("failed to decode prefixes annotation: %w", err)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tsuru/kubernetes-router/router"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// ModeIngressRoute is the mode key IngressRouteService is registered
+// under in RouterAPI.IngressServices.
+const ModeIngressRoute = "ingress-route"
+
+var (
+	ingressRouteGVR = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "ingressroutes"}
+	middlewareGVR   = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
+)
+
+// IngressRouteService manages a backend as a Traefik-style IngressRoute
+// CRD instead of a vanilla networking.k8s.io/v1 Ingress, so routes can
+// carry an ordered middleware chain and weighted backends.
+type IngressRouteService struct {
+	BaseService
+}
+
+var (
+	_ router.Service           = &IngressRouteService{}
+	_ router.ServiceMiddleware = &IngressRouteService{}
+)
+
+func (s *IngressRouteService) ingressRoutes() dynamic.ResourceInterface {
+	return s.Dynamic.Resource(ingressRouteGVR).Namespace(s.namespace())
+}
+
+func (s *IngressRouteService) middlewares() dynamic.ResourceInterface {
+	return s.Dynamic.Resource(middlewareGVR).Namespace(s.namespace())
+}
+
+// Create creates the IngressRoute for a backend with an empty route
+// list and no middleware attached; Update adds the routes.
+func (s *IngressRouteService) Create(id router.InstanceID, opts router.Opts) error {
+	name := s.ingressName(id)
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "traefik.io/v1alpha1",
+		"kind":       "IngressRoute",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": s.namespace(),
+		},
+		"spec": map[string]interface{}{
+			"routes": []interface{}{},
+		},
+	}}
+	_, err := s.ingressRoutes().Create(context.Background(), obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// Remove deletes the IngressRoute backing the app.
+func (s *IngressRouteService) Remove(id router.InstanceID) error {
+	err := s.ingressRoutes().Delete(context.Background(), s.ingressName(id), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Update attaches a "Rule" route matching the prefix to the backend
+// Service reported in routesData, preserving whatever middleware chain
+// is already attached.
+func (s *IngressRouteService) Update(id router.InstanceID, routesData router.RoutesRequestData) error {
+	obj, err := s.ingressRoutes().Get(context.Background(), s.ingressName(id), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	route := map[string]interface{}{
+		"kind":  "Rule",
+		"match": matchExpression(routesData.Prefix),
+		"services": []interface{}{
+			map[string]interface{}{
+				"name": routesData.ExtraData["service-name"],
+				"port": routesData.ExtraData["service-port"],
+				"weight": int64(1),
+			},
+		},
+	}
+	if mw := existingMiddlewareRefs(obj, routesData.Prefix); len(mw) > 0 {
+		route["middlewares"] = mw
+	}
+	routes, _, _ := unstructured.NestedSlice(obj.Object, "spec", "routes")
+	routes = upsertRoute(routes, routesData.Prefix, route)
+	if err := unstructured.SetNestedSlice(obj.Object, routes, "spec", "routes"); err != nil {
+		return err
+	}
+	_, err = s.ingressRoutes().Update(context.Background(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+// RemoveRoutes detaches the route matching routesData.Prefix, so a
+// prefix the app stops exposing stops being routed.
+func (s *IngressRouteService) RemoveRoutes(id router.InstanceID, routesData router.RoutesRequestData) error {
+	obj, err := s.ingressRoutes().Get(context.Background(), s.ingressName(id), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	routes, _, _ := unstructured.NestedSlice(obj.Object, "spec", "routes")
+	routes = removeRoute(routes, routesData.Prefix)
+	if err := unstructured.SetNestedSlice(obj.Object, routes, "spec", "routes"); err != nil {
+		return err
+	}
+	_, err = s.ingressRoutes().Update(context.Background(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+// GetAddresses is not meaningful for IngressRoute: Traefik does not
+// populate a status.loadBalancer block on the CRD itself, so addresses
+// must be read from the Traefik Service it's attached to instead.
+func (s *IngressRouteService) GetAddresses(id router.InstanceID) ([]string, error) {
+	return nil, nil
+}
+
+// Swap exchanges the route list of two backends' IngressRoutes.
+func (s *IngressRouteService) Swap(srcID, dstID router.InstanceID) error {
+	src, err := s.ingressRoutes().Get(context.Background(), s.ingressName(srcID), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	dst, err := s.ingressRoutes().Get(context.Background(), s.ingressName(dstID), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	srcRoutes, _, _ := unstructured.NestedSlice(src.Object, "spec", "routes")
+	dstRoutes, _, _ := unstructured.NestedSlice(dst.Object, "spec", "routes")
+	if err := unstructured.SetNestedSlice(src.Object, dstRoutes, "spec", "routes"); err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedSlice(dst.Object, srcRoutes, "spec", "routes"); err != nil {
+		return err
+	}
+	if _, err := s.ingressRoutes().Update(context.Background(), src, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	_, err = s.ingressRoutes().Update(context.Background(), dst, metav1.UpdateOptions{})
+	return err
+}
+
+// SupportedOptions reports the Opts keys this backend understands plus
+// the available middleware kinds, so /info can advertise them.
+func (s *IngressRouteService) SupportedOptions() map[string]string {
+	return map[string]string{
+		"domain":                        "",
+		"route":                         "",
+		"middleware-" + string(router.MiddlewareHeaders):        "Add/override response headers",
+		"middleware-" + string(router.MiddlewareRedirectScheme): "Redirect to a different scheme",
+		"middleware-" + string(router.MiddlewareStripPrefix):    "Strip path prefixes before forwarding",
+		"middleware-" + string(router.MiddlewareRateLimit):      "Cap the average/burst request rate",
+		"middleware-" + string(router.MiddlewareBasicAuth):      "Require HTTP basic auth",
+	}
+}
+
+func matchExpression(prefix string) string {
+	if prefix == "" || prefix == "/" {
+		return "PathPrefix(`/`)"
+	}
+	return fmt.Sprintf("PathPrefix(`%s`)", prefix)
+}
+
+func upsertRoute(routes []interface{}, prefix string, route map[string]interface{}) []interface{} {
+	want := matchExpression(prefix)
+	for i, r := range routes {
+		rm, ok := r.(map[string]interface{})
+		if ok && rm["match"] == want {
+			routes[i] = route
+			return routes
+		}
+	}
+	return append(routes, route)
+}
+
+func removeRoute(routes []interface{}, prefix string) []interface{} {
+	want := matchExpression(prefix)
+	filtered := routes[:0]
+	for _, r := range routes {
+		rm, ok := r.(map[string]interface{})
+		if ok && rm["match"] == want {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+func existingMiddlewareRefs(obj *unstructured.Unstructured, prefix string) []interface{} {
+	routes, _, _ := unstructured.NestedSlice(obj.Object, "spec", "routes")
+	want := matchExpression(prefix)
+	for _, r := range routes {
+		rm, ok := r.(map[string]interface{})
+		if ok && rm["match"] == want {
+			if mw, ok := rm["middlewares"].([]interface{}); ok {
+				return mw
+			}
+		}
+	}
+	return nil
+}
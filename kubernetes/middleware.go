@@ -0,0 +1,233 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tsuru/kubernetes-router/router"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func (s *IngressRouteService) middlewareName(id router.InstanceID, name string) string {
+	return fmt.Sprintf("%s-%s", s.ingressName(id), name)
+}
+
+// AddMiddleware creates or updates the Middleware CR for name and
+// appends a reference to it in every route currently attached to the
+// backend's IngressRoute, composing behaviors in call order.
+func (s *IngressRouteService) AddMiddleware(id router.InstanceID, name string, mw router.Middleware) error {
+	spec, err := middlewareSpec(mw)
+	if err != nil {
+		return err
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "traefik.io/v1alpha1",
+		"kind":       "Middleware",
+		"metadata": map[string]interface{}{
+			"name":      s.middlewareName(id, name),
+			"namespace": s.namespace(),
+		},
+		"spec": spec,
+	}}
+	_, err = s.middlewares().Create(context.Background(), obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = s.middlewares().Update(context.Background(), obj, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	return s.appendMiddlewareRef(id, name)
+}
+
+func (s *IngressRouteService) appendMiddlewareRef(id router.InstanceID, name string) error {
+	ing, err := s.ingressRoutes().Get(context.Background(), s.ingressName(id), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	routes, _, _ := unstructured.NestedSlice(ing.Object, "spec", "routes")
+	ref := map[string]interface{}{"name": s.middlewareName(id, name)}
+	for i, r := range routes {
+		rm, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mws, _ := rm["middlewares"].([]interface{})
+		if !containsMiddlewareRef(mws, ref["name"].(string)) {
+			mws = append(mws, ref)
+		}
+		rm["middlewares"] = mws
+		routes[i] = rm
+	}
+	if err := unstructured.SetNestedSlice(ing.Object, routes, "spec", "routes"); err != nil {
+		return err
+	}
+	_, err = s.ingressRoutes().Update(context.Background(), ing, metav1.UpdateOptions{})
+	return err
+}
+
+func containsMiddlewareRef(mws []interface{}, name string) bool {
+	for _, m := range mws {
+		if mm, ok := m.(map[string]interface{}); ok && mm["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMiddleware returns the middleware configuration stored in the
+// Middleware CR for name.
+func (s *IngressRouteService) GetMiddleware(id router.InstanceID, name string) (router.Middleware, error) {
+	obj, err := s.middlewares().Get(context.Background(), s.middlewareName(id, name), metav1.GetOptions{})
+	if err != nil {
+		return router.Middleware{}, err
+	}
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	return middlewareFromSpec(spec)
+}
+
+// RemoveMiddleware deletes the Middleware CR for name and drops its
+// reference from every route it was attached to.
+func (s *IngressRouteService) RemoveMiddleware(id router.InstanceID, name string) error {
+	mwName := s.middlewareName(id, name)
+	ing, err := s.ingressRoutes().Get(context.Background(), s.ingressName(id), metav1.GetOptions{})
+	if err == nil {
+		routes, _, _ := unstructured.NestedSlice(ing.Object, "spec", "routes")
+		for i, r := range routes {
+			rm, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			mws, _ := rm["middlewares"].([]interface{})
+			rm["middlewares"] = removeMiddlewareRef(mws, mwName)
+			routes[i] = rm
+		}
+		if err := unstructured.SetNestedSlice(ing.Object, routes, "spec", "routes"); err == nil {
+			if _, err := s.ingressRoutes().Update(context.Background(), ing, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+	err = s.middlewares().Delete(context.Background(), mwName, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func removeMiddlewareRef(mws []interface{}, name string) []interface{} {
+	filtered := mws[:0]
+	for _, m := range mws {
+		if mm, ok := m.(map[string]interface{}); ok && mm["name"] == name {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// middlewareSpec maps a router.Middleware into the Traefik Middleware
+// CRD spec shape for its Kind.
+func middlewareSpec(mw router.Middleware) (map[string]interface{}, error) {
+	switch mw.Kind {
+	case router.MiddlewareHeaders:
+		headers := make(map[string]interface{}, len(mw.Headers))
+		for k, v := range mw.Headers {
+			headers[k] = v
+		}
+		return map[string]interface{}{"headers": map[string]interface{}{"customResponseHeaders": headers}}, nil
+	case router.MiddlewareRedirectScheme:
+		if mw.RedirectScheme == nil {
+			return nil, fmt.Errorf("redirectScheme middleware requires redirectScheme config")
+		}
+		return map[string]interface{}{"redirectScheme": map[string]interface{}{
+			"scheme":    mw.RedirectScheme.Scheme,
+			"permanent": mw.RedirectScheme.Permanent,
+		}}, nil
+	case router.MiddlewareStripPrefix:
+		if mw.StripPrefix == nil {
+			return nil, fmt.Errorf("stripPrefix middleware requires stripPrefix config")
+		}
+		prefixes := make([]interface{}, len(mw.StripPrefix.Prefixes))
+		for i, p := range mw.StripPrefix.Prefixes {
+			prefixes[i] = p
+		}
+		return map[string]interface{}{"stripPrefix": map[string]interface{}{"prefixes": prefixes}}, nil
+	case router.MiddlewareRateLimit:
+		if mw.RateLimit == nil {
+			return nil, fmt.Errorf("rateLimit middleware requires rateLimit config")
+		}
+		return map[string]interface{}{"rateLimit": map[string]interface{}{
+			"average": int64(mw.RateLimit.Average),
+			"burst":   int64(mw.RateLimit.Burst),
+		}}, nil
+	case router.MiddlewareBasicAuth:
+		if mw.BasicAuth == nil {
+			return nil, fmt.Errorf("basicAuth middleware requires basicAuth config")
+		}
+		return map[string]interface{}{"basicAuth": map[string]interface{}{"secret": mw.BasicAuth.SecretName}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported middleware kind %q", mw.Kind)
+	}
+}
+
+// middlewareFromSpec reverses middlewareSpec, reconstructing the
+// router.Middleware a CR's spec describes.
+func middlewareFromSpec(spec map[string]interface{}) (router.Middleware, error) {
+	for kind, raw := range spec {
+		cfg, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch router.MiddlewareKind(kind) {
+		case router.MiddlewareHeaders:
+			headers := map[string]string{}
+			if h, ok := cfg["customResponseHeaders"].(map[string]interface{}); ok {
+				for k, v := range h {
+					headers[k], _ = v.(string)
+				}
+			}
+			return router.Middleware{Kind: router.MiddlewareHeaders, Headers: headers}, nil
+		case router.MiddlewareRedirectScheme:
+			scheme, _ := cfg["scheme"].(string)
+			permanent, _ := cfg["permanent"].(bool)
+			return router.Middleware{Kind: router.MiddlewareRedirectScheme, RedirectScheme: &router.RedirectSchemeMiddleware{Scheme: scheme, Permanent: permanent}}, nil
+		case router.MiddlewareStripPrefix:
+			var prefixes []string
+			if raw, ok := cfg["prefixes"].([]interface{}); ok {
+				for _, p := range raw {
+					if ps, ok := p.(string); ok {
+						prefixes = append(prefixes, ps)
+					}
+				}
+			}
+			return router.Middleware{Kind: router.MiddlewareStripPrefix, StripPrefix: &router.StripPrefixMiddleware{Prefixes: prefixes}}, nil
+		case router.MiddlewareRateLimit:
+			average, _ := toInt(cfg["average"])
+			burst, _ := toInt(cfg["burst"])
+			return router.Middleware{Kind: router.MiddlewareRateLimit, RateLimit: &router.RateLimitMiddleware{Average: average, Burst: burst}}, nil
+		case router.MiddlewareBasicAuth:
+			secret, _ := cfg["secret"].(string)
+			return router.Middleware{Kind: router.MiddlewareBasicAuth, BasicAuth: &router.BasicAuthMiddleware{SecretName: secret}}, nil
+		}
+	}
+	return router.Middleware{}, fmt.Errorf("middleware spec does not contain a recognized kind")
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	default:
+		return 0, false
+	}
+}
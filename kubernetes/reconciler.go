@@ -0,0 +1,271 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/tsuru/kubernetes-router/router"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Controller is a router.ReconcileQueue backed by an in-memory work
+// queue and a pool of workers that apply each DesiredState against the
+// router.Service registered for its mode, retrying transient failures
+// with capped exponential backoff and jitter. At most one worker ever
+// reconciles a given key at a time (see reconcile), so a newer
+// DesiredState enqueued while an older one is still being applied can't
+// race it. It also runs shared informers over Ingress/Service/Secret;
+// any Add/Update/Delete event they observe (e.g. an operator editing a
+// Secret by hand) marks every tracked item pending again and requeues
+// it, so external changes eventually get reapplied instead of only
+// reacting to RouterAPI calls. This is a coarse, whole-queue resync,
+// not a targeted one keyed off which object actually changed.
+type Controller struct {
+	Services map[string]router.Service
+
+	mu       sync.Mutex
+	items    map[string]*queuedItem
+	work     chan string
+	inFlight map[string]bool
+
+	informerFactory informers.SharedInformerFactory
+}
+
+type queuedItem struct {
+	id         router.InstanceID
+	mode       string
+	desired    router.DesiredState
+	state      router.ReconcileState
+	lastErr    string
+	enqueuedAt time.Time
+}
+
+// NewController creates a Controller with workerCount background
+// workers applying queued changes and shared informers resyncing every
+// resync interval.
+func NewController(client kubernetes.Interface, services map[string]router.Service, workerCount int, resync time.Duration) *Controller {
+	c := &Controller{
+		Services:        services,
+		items:           map[string]*queuedItem{},
+		work:            make(chan string, 1024),
+		inFlight:        map[string]bool{},
+		informerFactory: informers.NewSharedInformerFactory(client, resync),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.resyncAll() },
+		UpdateFunc: func(_, _ interface{}) { c.resyncAll() },
+		DeleteFunc: func(interface{}) { c.resyncAll() },
+	}
+	c.informerFactory.Networking().V1().Ingresses().Informer().AddEventHandler(handler)
+	c.informerFactory.Core().V1().Services().Informer().AddEventHandler(handler)
+	c.informerFactory.Core().V1().Secrets().Informer().AddEventHandler(handler)
+	for i := 0; i < workerCount; i++ {
+		go c.worker()
+	}
+	return c
+}
+
+// resyncAll marks every tracked item pending and requeues it, so an
+// external change picked up by the informers gets reapplied even
+// though it didn't come through Enqueue.
+func (c *Controller) resyncAll() {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.items))
+	for key, item := range c.items {
+		item.state = router.ReconcileStatePending
+		item.enqueuedAt = time.Now()
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+	for _, key := range keys {
+		select {
+		case c.work <- key:
+		default:
+		}
+	}
+}
+
+// Run starts the shared informers and blocks until stopCh is closed.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	c.informerFactory.Start(stopCh)
+	c.informerFactory.WaitForCacheSync(stopCh)
+	<-stopCh
+}
+
+func itemKey(mode string, id router.InstanceID) string {
+	return fmt.Sprintf("%s/%s/%s", mode, id.AppName, id.InstanceName)
+}
+
+// Enqueue implements router.ReconcileQueue.
+func (c *Controller) Enqueue(id router.InstanceID, mode string, desired router.DesiredState) (string, error) {
+	key := itemKey(mode, id)
+	c.mu.Lock()
+	c.items[key] = &queuedItem{
+		id:         id,
+		mode:       mode,
+		desired:    desired,
+		state:      router.ReconcileStatePending,
+		enqueuedAt: time.Now(),
+	}
+	c.mu.Unlock()
+	select {
+	case c.work <- key:
+	default:
+		return "", fmt.Errorf("reconcile queue is full")
+	}
+	return key, nil
+}
+
+// Status implements router.ReconcileQueue.
+func (c *Controller) Status(id router.InstanceID, mode string) (router.ReconcileStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[itemKey(mode, id)]
+	if !ok {
+		return router.ReconcileStatus{}, fmt.Errorf("no reconcile state for %s/%s", mode, id.AppName)
+	}
+	return router.ReconcileStatus{State: item.state, LastError: item.lastErr}, nil
+}
+
+// Depth implements router.ReconcileQueue.
+func (c *Controller) Depth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	depth := 0
+	for _, item := range c.items {
+		if item.state == router.ReconcileStatePending {
+			depth++
+		}
+	}
+	return depth
+}
+
+// OldestPendingAge implements router.ReconcileQueue.
+func (c *Controller) OldestPendingAge() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest time.Time
+	for _, item := range c.items {
+		if item.state != router.ReconcileStatePending {
+			continue
+		}
+		if oldest.IsZero() || item.enqueuedAt.Before(oldest) {
+			oldest = item.enqueuedAt
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+func (c *Controller) worker() {
+	for key := range c.work {
+		c.reconcile(key)
+	}
+}
+
+// reconcile applies the current desired state for key, retrying
+// transient failures with capped exponential backoff. If another worker
+// is already reconciling this key, it defers to that worker instead of
+// racing it: that worker's loop notices the item was superseded (see
+// below) and re-applies the latest state itself once its current
+// attempt finishes.
+func (c *Controller) reconcile(key string) {
+	c.mu.Lock()
+	if c.inFlight[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.inFlight[key] = true
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		item, ok := c.items[key]
+		if !ok {
+			delete(c.inFlight, key)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 2 * time.Minute
+
+		err := backoff.Retry(func() error {
+			return c.apply(item)
+		}, b)
+
+		c.mu.Lock()
+		superseded := c.items[key] != item
+		if err != nil {
+			item.state = router.ReconcileStateFailed
+			item.lastErr = err.Error()
+		} else {
+			item.state = router.ReconcileStateReconciled
+			item.lastErr = ""
+		}
+		if !superseded {
+			// Released under the same lock as the superseded check, so a
+			// later Enqueue either is seen above or finds key free.
+			delete(c.inFlight, key)
+		}
+		c.mu.Unlock()
+
+		if !superseded {
+			return
+		}
+		// A newer DesiredState was enqueued for key while the attempt
+		// above was in flight; loop around and apply it instead of
+		// leaving it for a second worker to pick up concurrently.
+	}
+}
+
+func (c *Controller) apply(item *queuedItem) error {
+	svc, ok := c.Services[item.mode]
+	if !ok {
+		return backoff.Permanent(fmt.Errorf("no Service registered for mode %q", item.mode))
+	}
+	d := item.desired
+	switch {
+	case d.Create != nil:
+		return svc.Create(item.id, *d.Create)
+	case d.Remove:
+		return svc.Remove(item.id)
+	case d.Routes != nil:
+		return svc.Update(item.id, *d.Routes)
+	case d.RemoveRoutes != nil:
+		return svc.RemoveRoutes(item.id, *d.RemoveRoutes)
+	case d.Swap != nil:
+		return svc.Swap(item.id, *d.Swap)
+	case d.Certificate != nil:
+		tlsSvc, ok := svc.(router.ServiceTLS)
+		if !ok {
+			return backoff.Permanent(fmt.Errorf("mode %q does not support certificates", item.mode))
+		}
+		return tlsSvc.AddCertificate(item.id, d.CertName, *d.Certificate)
+	case d.Cname != nil:
+		cnameSvc, ok := svc.(router.ServiceCNAME)
+		if !ok {
+			return backoff.Permanent(fmt.Errorf("mode %q does not support CNAMEs", item.mode))
+		}
+		if err := cnameSvc.SetCname(item.id, *d.Cname); err != nil {
+			return err
+		}
+		if acmeSvc, ok := svc.(router.ServiceACME); ok {
+			return acmeSvc.SyncTLSHosts(item.id)
+		}
+		return nil
+	default:
+		return backoff.Permanent(fmt.Errorf("empty desired state"))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tsuru/kubernetes-router/router"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// secretName returns the name of the Secret holding a given
+// certificate, so multiple certificates can be attached to the same
+// backend.
+func (s *IngressService) secretName(id router.InstanceID, certName string) string {
+	return fmt.Sprintf("%s-cert-%s", s.ingressName(id), certName)
+}
+
+// AddCertificate stores the PEM certificate/key pair as a Kubernetes
+// TLS Secret and references it from the Ingress's tls spec. When
+// cert.Issuer is set, the certificate is managed by cert-manager
+// instead; see addManagedCertificate.
+func (s *IngressService) AddCertificate(id router.InstanceID, certName string, cert router.CertData) error {
+	if cert.Issuer != "" {
+		return s.addManagedCertificate(id, certName, cert)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.secretName(id, certName),
+			Namespace: s.namespace(),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(cert.Certificate),
+			corev1.TLSPrivateKeyKey: []byte(cert.Key),
+		},
+	}
+	_, err := s.Client.CoreV1().Secrets(s.namespace()).Create(context.Background(), secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = s.Client.CoreV1().Secrets(s.namespace()).Update(context.Background(), secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.setCertIssuer(id, certName, ""); err != nil {
+		return err
+	}
+	return s.attachSecretToIngress(id, certName)
+}
+
+func (s *IngressService) attachSecretToIngress(id router.InstanceID, certName string) error {
+	ing, err := s.getOwnedIngress(id)
+	if err != nil {
+		return err
+	}
+	ing.Spec.TLS = upsertTLSSecret(ing.Spec.TLS, s.secretName(id, certName))
+	_, err = s.Client.NetworkingV1().Ingresses(s.namespace()).Update(context.Background(), ing, metav1.UpdateOptions{})
+	return err
+}
+
+// GetCertificate returns certName's certificate. Whether it was issued
+// by cert-manager or supplied directly as PEM is determined per
+// certificate (via certIssuer), not per service, so the two kinds can
+// coexist on the same backend.
+func (s *IngressService) GetCertificate(id router.InstanceID, certName string) (router.CertData, error) {
+	issuer, err := s.certIssuer(id, certName)
+	if err != nil {
+		return router.CertData{}, err
+	}
+	if issuer != "" {
+		return s.managedCertificateStatus(id, certName, issuer)
+	}
+	secret, err := s.Client.CoreV1().Secrets(s.namespace()).Get(context.Background(), s.secretName(id, certName), metav1.GetOptions{})
+	if err != nil {
+		return router.CertData{}, err
+	}
+	return router.CertData{
+		Certificate: string(secret.Data[corev1.TLSCertKey]),
+		Key:         string(secret.Data[corev1.TLSPrivateKeyKey]),
+	}, nil
+}
+
+// RemoveCertificate deletes the Secret holding certName, along with its
+// cert-manager Certificate object if it was managed.
+func (s *IngressService) RemoveCertificate(id router.InstanceID, certName string) error {
+	issuer, err := s.certIssuer(id, certName)
+	if err != nil {
+		return err
+	}
+	if issuer != "" {
+		if err := s.certificates().Delete(context.Background(), s.certificateName(id, certName), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err := s.setCertIssuer(id, certName, ""); err != nil {
+			return err
+		}
+	}
+	return s.Client.CoreV1().Secrets(s.namespace()).Delete(context.Background(), s.secretName(id, certName), metav1.DeleteOptions{})
+}
+
+// upsertTLSSecret adds secretName to tls, reusing its entry if one
+// already references it instead of appending a duplicate.
+func upsertTLSSecret(tls []networkingv1.IngressTLS, secretName string) []networkingv1.IngressTLS {
+	for i := range tls {
+		if tls[i].SecretName == secretName {
+			return tls
+		}
+	}
+	return append(tls, networkingv1.IngressTLS{SecretName: secretName})
+}
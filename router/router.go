@@ -0,0 +1,247 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package router defines the interfaces and shared types implemented by
+// the Kubernetes backends (see the kubernetes package) and consumed by
+// the HTTP API (see the api package).
+package router
+
+import "time"
+
+// InstanceID identifies a single tsuru router instance, scoping every
+// Service call to the app (and, when tsuru runs multiple router
+// instances per app, the specific instance) it targets.
+type InstanceID struct {
+	AppName      string
+	InstanceName string
+}
+
+// Opts are the options sent by tsuru when creating a backend.
+type Opts struct {
+	Pool        string   `json:"pool"`
+	ExposedPort string   `json:"exposed-port"`
+	Domain      string   `json:"domain"`
+	Route       string   `json:"route"`
+	HeaderOpts  []string `json:"-"`
+}
+
+// ExtraData carries backend-specific information about how to reach an
+// app process for a single route prefix, such as the Kubernetes Service
+// name and port tsuru expects traffic to be forwarded to.
+type ExtraData map[string]string
+
+// RoutesRequestData is the body tsuru sends to addRoutes/removeRoutes.
+// It is sent once per prefix the app exposes, including the default
+// ("/") one; Service.Update accumulates the prefixes it has seen for a
+// given InstanceID, and Service.RemoveRoutes drops a prefix once tsuru
+// reports it's no longer exposed.
+type RoutesRequestData struct {
+	Prefix    string    `json:"prefix"`
+	ExtraData ExtraData `json:"extraData"`
+}
+
+// CertData is a TLS certificate and key pair for a backend. When Issuer
+// is set on a request, the certificate is managed by cert-manager
+// instead of being supplied directly; see ServiceACME. The Ready,
+// RenewalTime and DNSNames fields are only populated on the response to
+// getCertificate for a cert-manager managed certificate, reflecting the
+// live status of its cert-manager Certificate object.
+type CertData struct {
+	Certificate string     `json:"certificate"`
+	Key         string     `json:"key"`
+	Issuer      string     `json:"issuer,omitempty"`
+	Ready       *bool      `json:"ready,omitempty"`
+	RenewalTime *time.Time `json:"renewalTime,omitempty"`
+	DNSNames    []string   `json:"dnsNames,omitempty"`
+}
+
+// Service is the interface implemented by every Kubernetes backend
+// registered in RouterAPI.IngressServices.
+type Service interface {
+	Create(id InstanceID, opts Opts) error
+	Remove(id InstanceID) error
+	Update(id InstanceID, routesData RoutesRequestData) error
+	RemoveRoutes(id InstanceID, routesData RoutesRequestData) error
+	Swap(srcID InstanceID, dstID InstanceID) error
+	GetAddresses(id InstanceID) ([]string, error)
+	SupportedOptions() map[string]string
+}
+
+// HealthcheckableService is implemented by Services that can report
+// their own health, checked by RouterAPI.Healthcheck.
+type HealthcheckableService interface {
+	Healthcheck() error
+}
+
+// ServiceTLS is implemented by Services that manage TLS certificates on
+// behalf of a backend.
+type ServiceTLS interface {
+	AddCertificate(id InstanceID, certName string, cert CertData) error
+	GetCertificate(id InstanceID, certName string) (CertData, error)
+	RemoveCertificate(id InstanceID, certName string) error
+}
+
+// CnameResp lists the CNAMEs registered for a backend.
+type CnameResp struct {
+	Cnames []string `json:"cnames"`
+}
+
+// ServiceCNAME is implemented by Services that support additional
+// CNAMEs pointing at a backend.
+type ServiceCNAME interface {
+	SetCname(id InstanceID, cname string) error
+	GetCnames(id InstanceID) (*CnameResp, error)
+	UnsetCname(id InstanceID, cname string) error
+}
+
+// ServiceClass is implemented by Services that stamp and enforce a
+// Kubernetes IngressClass on the resources they manage, letting
+// multiple kubernetes-router instances share a cluster by each owning a
+// distinct class/controller pair.
+type ServiceClass interface {
+	IngressClass() string
+}
+
+// MiddlewareKind enumerates the middleware types a ServiceMiddleware
+// backend is expected to support.
+type MiddlewareKind string
+
+const (
+	MiddlewareHeaders        MiddlewareKind = "headers"
+	MiddlewareRedirectScheme MiddlewareKind = "redirectScheme"
+	MiddlewareStripPrefix    MiddlewareKind = "stripPrefix"
+	MiddlewareRateLimit      MiddlewareKind = "rateLimit"
+	MiddlewareBasicAuth      MiddlewareKind = "basicAuth"
+)
+
+// Middleware describes a single middleware to attach to a backend's
+// route chain. Exactly one of the kind-specific fields is expected to
+// be set, matching Kind.
+type Middleware struct {
+	Kind MiddlewareKind `json:"kind"`
+
+	Headers        map[string]string        `json:"headers,omitempty"`
+	RedirectScheme *RedirectSchemeMiddleware `json:"redirectScheme,omitempty"`
+	StripPrefix    *StripPrefixMiddleware    `json:"stripPrefix,omitempty"`
+	RateLimit      *RateLimitMiddleware      `json:"rateLimit,omitempty"`
+	BasicAuth      *BasicAuthMiddleware      `json:"basicAuth,omitempty"`
+}
+
+// RedirectSchemeMiddleware redirects requests to a different scheme
+// (e.g. http -> https).
+type RedirectSchemeMiddleware struct {
+	Scheme    string `json:"scheme"`
+	Permanent bool   `json:"permanent"`
+}
+
+// StripPrefixMiddleware removes the given path prefixes before
+// forwarding the request to the backend.
+type StripPrefixMiddleware struct {
+	Prefixes []string `json:"prefixes"`
+}
+
+// RateLimitMiddleware caps the average and burst request rate allowed
+// through to the backend.
+type RateLimitMiddleware struct {
+	Average int `json:"average"`
+	Burst   int `json:"burst"`
+}
+
+// BasicAuthMiddleware requires HTTP basic auth, with credentials stored
+// in the named Kubernetes Secret.
+type BasicAuthMiddleware struct {
+	SecretName string `json:"secretName"`
+}
+
+// ServiceMiddleware is implemented by Services that support attaching
+// an ordered chain of middlewares to a backend's routes (see the
+// /backend/{name}/middleware/{mwname} endpoints).
+type ServiceMiddleware interface {
+	AddMiddleware(id InstanceID, name string, mw Middleware) error
+	GetMiddleware(id InstanceID, name string) (Middleware, error)
+	RemoveMiddleware(id InstanceID, name string) error
+}
+
+// ServiceACME is implemented by ServiceTLS backends that can also issue
+// certificates through cert-manager: AddCertificate and GetCertificate
+// branch internally on CertData.Issuer/on whether a given certificate
+// was cert-manager-issued, so callers never need to special-case ACME
+// themselves. SyncTLSHosts is the one operation that ACME support adds
+// on top of ServiceTLS: it keeps every managed certificate's DNS names
+// in sync with the backend's current CNAMEs whenever they change.
+type ServiceACME interface {
+	SyncTLSHosts(id InstanceID) error
+}
+
+// DesiredState is a single desired-state change queued for the
+// background reconciler. Exactly one change is expected to be set,
+// mirroring whichever RouterAPI handler enqueued it; CertName is set
+// alongside Certificate to name it.
+type DesiredState struct {
+	Create       *Opts
+	Remove       bool
+	Routes       *RoutesRequestData
+	RemoveRoutes *RoutesRequestData
+	Swap         *InstanceID
+	CertName     string
+	Certificate  *CertData
+	Cname        *string
+}
+
+// ReconcileState is the lifecycle state of a queued DesiredState as it
+// moves toward being applied to Kubernetes.
+type ReconcileState string
+
+const (
+	ReconcileStatePending    ReconcileState = "Pending"
+	ReconcileStateReconciled ReconcileState = "Reconciled"
+	ReconcileStateFailed     ReconcileState = "Failed"
+)
+
+// ReconcileStatus reports the outcome of the most recently queued
+// DesiredState for a backend.
+type ReconcileStatus struct {
+	State     ReconcileState `json:"state"`
+	LastError string         `json:"lastError,omitempty"`
+}
+
+// ReconcileQueue enqueues desired-state changes for a background
+// controller to apply against Kubernetes, retrying transient failures
+// with backoff instead of surfacing them to the HTTP caller.
+type ReconcileQueue interface {
+	// Enqueue records desired for id/mode and returns an opaque task id
+	// the caller can use to correlate with Status.
+	Enqueue(id InstanceID, mode string, desired DesiredState) (taskID string, err error)
+
+	// Status reports the reconcile state of the most recent item
+	// enqueued for id/mode.
+	Status(id InstanceID, mode string) (ReconcileStatus, error)
+
+	// Depth is the number of items still pending, used by
+	// RouterAPI.Healthcheck to detect a stuck controller.
+	Depth() int
+
+	// OldestPendingAge is how long the oldest still-pending item has
+	// been queued, used by RouterAPI.Healthcheck alongside Depth.
+	OldestPendingAge() time.Duration
+}
+
+// describedOptions documents the Opts keys shared by the Services'
+// SupportedOptions, so /info can fall back to a shared
+// description when the Service itself doesn't supply one.
+var describedOptions = map[string]string{
+	"exposed-port": "Port to be exposed by the Load Balancer. Defaults to 80.",
+	"domain":       "Domain that the router will use to build the final address.",
+	"route":        "Default route prefix used when domain is set.",
+}
+
+// DescribedOptions returns the human readable description for every
+// option known to the router package.
+func DescribedOptions() map[string]string {
+	opts := make(map[string]string, len(describedOptions))
+	for k, v := range describedOptions {
+		opts[k] = v
+	}
+	return opts
+}